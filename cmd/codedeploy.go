@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+// ecsAppSpec is the subset of the ECS CodeDeploy AppSpec format ship needs
+// to point a blue/green (or canary) deployment at a freshly registered
+// task definition.
+type ecsAppSpec struct {
+	Version   string             `json:"version"`
+	Resources []ecsAppSpecTarget `json:"Resources"`
+}
+
+type ecsAppSpecTarget struct {
+	TargetService ecsAppSpecTargetService `json:"TargetService"`
+}
+
+type ecsAppSpecTargetService struct {
+	Type       string                     `json:"Type"`
+	Properties ecsAppSpecTargetProperties `json:"Properties"`
+}
+
+type ecsAppSpecTargetProperties struct {
+	TaskDefinition   string                     `json:"TaskDefinition"`
+	LoadBalancerInfo ecsAppSpecLoadBalancerInfo `json:"LoadBalancerInfo"`
+}
+
+type ecsAppSpecLoadBalancerInfo struct {
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int64  `json:"ContainerPort"`
+}
+
+// deployViaCodeDeploy drives a CodeDeploy blue/green or canary deployment
+// for registerdTaskDef, waiting for it to finish and auto-rolling back on
+// failure, mirroring the rolling-update flow in execute.
+func (f *deployCmd) deployViaCodeDeploy(sess *session.Session, service *ecs.Service, registerdTaskDef *ecs.TaskDefinition, l *log.Logger) error {
+	region := getAWSRegion()
+	client := codedeploy.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	appSpec, err := buildAppSpec(registerdTaskDef, service)
+	if err != nil {
+		return err
+	}
+
+	params := &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String(f.codeDeployApp),
+		DeploymentGroupName: aws.String(f.codeDeployDeployGroup),
+		Revision: &codedeploy.RevisionLocation{
+			RevisionType: aws.String("AppSpecContent"),
+			AppSpecContent: &codedeploy.AppSpecContent{
+				Content: aws.String(appSpec),
+			},
+		},
+		AutoRollbackConfiguration: &codedeploy.AutoRollbackConfiguration{
+			Enabled: aws.Bool(true),
+			Events:  []*string{aws.String("DEPLOYMENT_FAILURE")},
+		},
+	}
+
+	if f.strategy == "canary" {
+		deploymentConfig, err := ensureCanaryDeploymentConfig(client, f.canaryPercent, f.canaryIntervalInMinutes)
+		if err != nil {
+			return err
+		}
+		params.DeploymentConfigName = aws.String(deploymentConfig)
+	}
+
+	res, err := client.CreateDeployment(params)
+	if err != nil {
+		return err
+	}
+
+	l.Log(fmt.Sprintf("codedeploy deployment started: %s\n", *res.DeploymentId))
+
+	return waitCodeDeployDeployment(client, *res.DeploymentId, l)
+}
+
+func buildAppSpec(taskDef *ecs.TaskDefinition, service *ecs.Service) (string, error) {
+	container, port, err := selectLoadBalancedContainer(taskDef, service)
+	if err != nil {
+		return "", err
+	}
+
+	spec := ecsAppSpec{
+		Version: "0.0",
+		Resources: []ecsAppSpecTarget{
+			{
+				TargetService: ecsAppSpecTargetService{
+					Type: "AWS::ECS::Service",
+					Properties: ecsAppSpecTargetProperties{
+						TaskDefinition: *taskDef.TaskDefinitionArn,
+						LoadBalancerInfo: ecsAppSpecLoadBalancerInfo{
+							ContainerName: *container.Name,
+							ContainerPort: port,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// selectLoadBalancedContainer returns the container (and port) CodeDeploy
+// should shift traffic to. It prefers the service's own load balancer
+// config, since that's authoritative for which container/port is actually
+// registered with the target group; a task def can have several containers
+// with port mappings (e.g. a sidecar), and only one of them is load
+// balanced. Falls back to the first container with a port mapping if the
+// service has no load balancer configured.
+func selectLoadBalancedContainer(taskDef *ecs.TaskDefinition, service *ecs.Service) (*ecs.ContainerDefinition, int64, error) {
+	if len(taskDef.ContainerDefinitions) == 0 {
+		return nil, 0, fmt.Errorf("task definition %s has no container definitions", *taskDef.TaskDefinitionArn)
+	}
+
+	if len(service.LoadBalancers) > 0 {
+		lb := service.LoadBalancers[0]
+		for _, c := range taskDef.ContainerDefinitions {
+			if *c.Name == *lb.ContainerName {
+				return c, *lb.ContainerPort, nil
+			}
+		}
+		return nil, 0, fmt.Errorf("task definition %s has no container named %s (from the service's load balancer config)", *taskDef.TaskDefinitionArn, *lb.ContainerName)
+	}
+
+	for _, c := range taskDef.ContainerDefinitions {
+		if len(c.PortMappings) > 0 {
+			return c, *c.PortMappings[0].ContainerPort, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("task definition %s has no container with a port mapping", *taskDef.TaskDefinitionArn)
+}
+
+// ensureCanaryDeploymentConfig returns the name of a TimeBasedCanary
+// deployment config matching percent/intervalInMinutes, creating one on
+// the fly if it doesn't already exist.
+func ensureCanaryDeploymentConfig(client *codedeploy.CodeDeploy, percent, intervalInMinutes int64) (string, error) {
+	name := fmt.Sprintf("ship-canary-%dpct-%dmin", percent, intervalInMinutes)
+
+	_, err := client.GetDeploymentConfig(&codedeploy.GetDeploymentConfigInput{
+		DeploymentConfigName: aws.String(name),
+	})
+	if err == nil {
+		return name, nil
+	}
+
+	_, err = client.CreateDeploymentConfig(&codedeploy.CreateDeploymentConfigInput{
+		DeploymentConfigName: aws.String(name),
+		ComputePlatform:      aws.String("ECS"),
+		TrafficRoutingConfig: &codedeploy.TrafficRoutingConfig{
+			Type: aws.String("TimeBasedCanary"),
+			TimeBasedCanary: &codedeploy.TimeBasedCanary{
+				CanaryPercentage: aws.Int64(percent),
+				CanaryInterval:   aws.Int64(intervalInMinutes),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// waitCodeDeployDeployment polls a deployment until it reaches a terminal
+// state, streaming status transitions to the logger and Slack the way
+// WaitUpdateService streams ECS deployment events. Rollback-on-failure is
+// handled entirely by the AutoRollbackConfiguration passed to
+// CreateDeployment; CodeDeploy refuses to StopDeployment once a
+// deployment has already reached a terminal state, so this only reports
+// the outcome.
+func waitCodeDeployDeployment(client *codedeploy.CodeDeploy, deploymentID string, l *log.Logger) error {
+	seen := map[string]bool{}
+
+	for {
+		res, err := client.GetDeployment(&codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(deploymentID),
+		})
+		if err != nil {
+			return err
+		}
+
+		info := res.DeploymentInfo
+		status := *info.Status
+		if !seen[status] {
+			seen[status] = true
+			msg := fmt.Sprintf("codedeploy deployment %s: %s\n", deploymentID, status)
+			l.Log(msg)
+
+			switch status {
+			case "Succeeded":
+				l.Slack("good", msg)
+			case "Failed", "Stopped":
+				l.Slack("danger", msg)
+			default:
+				l.Slack("normal", msg)
+			}
+		}
+
+		switch status {
+		case "Succeeded":
+			return nil
+		case "Failed", "Stopped":
+			return fmt.Errorf("codedeploy deployment %s %s", deploymentID, status)
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
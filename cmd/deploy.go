@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,7 +14,6 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecs"
 
-	"github.com/docker/distribution/reference"
 	"github.com/oklog/ulid"
 	"github.com/spf13/cobra"
 
@@ -27,12 +27,18 @@ var ECRRegex *regexp.Regexp = func() *regexp.Regexp {
 }()
 
 type deployCmd struct {
-	cluster         string
-	serviceName     string
-	revision        int
-	images          imageOptions
-	backend         string
-	slackWebhookUrl string
+	cluster                 string
+	serviceName             string
+	revision                int
+	images                  imageOptions
+	backend                 string
+	slackWebhookUrl         string
+	strategy                string
+	codeDeployApp           string
+	codeDeployDeployGroup   string
+	canaryPercent           int64
+	canaryIntervalInMinutes int64
+	pinDigest               bool
 }
 
 func NewDeployCommand(out, errOut io.Writer) *cobra.Command {
@@ -58,6 +64,12 @@ func NewDeployCommand(out, errOut io.Writer) *cobra.Command {
 	cmd.Flags().Var(&f.images, "image", "base image of ECR image")
 	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
 	cmd.Flags().StringVar(&f.slackWebhookUrl, "slack-webhook-url", "", "slack webhook URL")
+	cmd.Flags().StringVar(&f.strategy, "strategy", "rolling", "deploy strategy: rolling, bluegreen or canary")
+	cmd.Flags().StringVar(&f.codeDeployApp, "codedeploy-app", "", "CodeDeploy application name (required for bluegreen/canary)")
+	cmd.Flags().StringVar(&f.codeDeployDeployGroup, "codedeploy-deployment-group", "", "CodeDeploy deployment group name (required for bluegreen/canary)")
+	cmd.Flags().Int64Var(&f.canaryPercent, "canary-percent", 10, "percentage of traffic to shift on the first canary increment")
+	cmd.Flags().Int64Var(&f.canaryIntervalInMinutes, "canary-interval", 5, "minutes between canary traffic increments")
+	cmd.Flags().BoolVar(&f.pinDigest, "pin-digest", false, "pin container images to their resolved content digest instead of retagging")
 
 	return cmd
 }
@@ -75,6 +87,19 @@ func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) erro
 		return errors.New("--image is required")
 	}
 
+	switch f.strategy {
+	case "rolling":
+	case "bluegreen", "canary":
+		if f.codeDeployApp == "" {
+			return errors.New("--codedeploy-app is required")
+		}
+		if f.codeDeployDeployGroup == "" {
+			return errors.New("--codedeploy-deployment-group is required")
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown strategy %s", f.strategy))
+	}
+
 	region := getAWSRegion()
 	if region == "" {
 		return errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
@@ -115,6 +140,7 @@ func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) erro
 
 	var taskDef *ecs.TaskDefinition
 	var registerdTaskDef *ecs.TaskDefinition
+	var digests map[string]string
 	{
 		taskDefArn := *service.TaskDefinition
 		taskDefArn, err = libecs.SpecifyRevision(f.revision, taskDefArn)
@@ -127,29 +153,33 @@ func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) erro
 			return err
 		}
 
-		newTaskDef, err := f.createNewTaskDefinition(uniqueID, taskDef)
+		var newTaskDef *ecs.TaskDefinition
+		newTaskDef, digests, err = createNewTaskDefinition(&f.images, ecrClient, uniqueID, taskDef, f.pinDigest)
 		if err != nil {
 			return err
 		}
 
-		for _, v := range taskDef.ContainerDefinitions {
-			img, err := f.parseDockerImage(*v.Image)
-			if err != nil {
-				return err
-			}
-
-			opt := f.images.Get(img.RepositoryName)
-			if opt == nil {
-				return errors.New(fmt.Sprintf("can not found image option %s", img.RepositoryName))
-			}
-
-			err = f.tagDockerImage(ecrClient, img.RepositoryName, opt.Tag, uniqueID)
-			if err != nil {
-				return err
+		if !f.pinDigest {
+			for _, v := range taskDef.ContainerDefinitions {
+				img, err := parseDockerImage(*v.Image)
+				if err != nil {
+					return err
+				}
+
+				opt := f.images.Get(img.RepositoryName)
+				if opt == nil {
+					continue
+				}
+
+				backend := imageBackendFor(&f.images, ecrClient, img)
+				err = backend.Retag(context.Background(), img, opt.Tag, uniqueID)
+				if err != nil {
+					return err
+				}
 			}
 		}
 
-		registerdTaskDef, err = f.registerTaskDefinition(client, newTaskDef)
+		registerdTaskDef, err = registerTaskDefinition(client, newTaskDef)
 		if err != nil {
 			return err
 		}
@@ -160,126 +190,40 @@ func (f *deployCmd) execute(_ *cobra.Command, args []string, l *log.Logger) erro
 	l.Log(msg)
 	l.Slack("normal", msg)
 
-	err = libecs.UpdateService(client, service, registerdTaskDef)
-	if err != nil {
-		return err
-	}
-
-	l.Log(fmt.Sprintf("service updating\n"))
-
-	err = libecs.WaitUpdateService(client, f.cluster, f.serviceName, l)
-	if err != nil {
-		return err
-	}
-
-	err = historyManager.PushState(
-		int(*registerdTaskDef.Revision),
-		fmt.Sprintf("deploy: %d -> %d", *taskDef.Revision, *registerdTaskDef.Revision),
-	)
-	if err != nil {
-		return err
-	}
-
-	msg = fmt.Sprintf("successfully updated\n")
-	l.Log(msg)
-	l.Slack("good", msg)
+	if f.strategy == "rolling" {
+		err = libecs.UpdateService(client, service, registerdTaskDef)
+		if err != nil {
+			return err
+		}
 
-	return nil
-}
+		l.Log(fmt.Sprintf("service updating\n"))
 
-func (f *deployCmd) createNewTaskDefinition(id string, taskDef *ecs.TaskDefinition) (*ecs.TaskDefinition, error) {
-	newTaskDef := *taskDef // shallow copy
-	var containers []*ecs.ContainerDefinition
-	for _, vp := range taskDef.ContainerDefinitions {
-		v := *vp // shallow copy
-		img, err := f.parseDockerImage(*v.Image)
+		err = libecs.WaitUpdateService(client, f.cluster, f.serviceName, l)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		if f.isECRHosted(img) {
-			v.Image = aws.String(fmt.Sprintf("%s:%s", img.Name, id))
-			containers = append(containers, &v)
+	} else {
+		err = f.deployViaCodeDeploy(sess, service, registerdTaskDef, l)
+		if err != nil {
+			return err
 		}
 	}
-	newTaskDef.ContainerDefinitions = containers
 
-	return &newTaskDef, nil
-}
-
-type dockerImage struct {
-	Name           string
-	Tag            string
-	RepositoryName string
-	HostName       string
-}
+	historyMsg := fmt.Sprintf("deploy: %d -> %d", *taskDef.Revision, *registerdTaskDef.Revision)
 
-func (f *deployCmd) parseDockerImage(image string) (*dockerImage, error) {
-	ref, err := reference.Parse(image)
-	if err != nil {
-		return nil, err
-	}
-
-	hostName, repoName := reference.SplitHostname(ref.(reference.Named))
-	return &dockerImage{
-		Name:           ref.(reference.Named).Name(),
-		Tag:            ref.(reference.Tagged).Tag(),
-		RepositoryName: repoName,
-		HostName:       hostName,
-	}, nil
-}
-
-func (f *deployCmd) isECRHosted(image *dockerImage) bool {
-	return ECRRegex.MatchString(image.HostName)
-}
-
-func (f *deployCmd) registerTaskDefinition(client *ecs.ECS, taskDef *ecs.TaskDefinition) (*ecs.TaskDefinition, error) {
-	params := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    taskDef.ContainerDefinitions,
-		Cpu:                     taskDef.Cpu,
-		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
-		Family:                  taskDef.Family,
-		Memory:                  taskDef.Memory,
-		NetworkMode:             taskDef.NetworkMode,
-		PlacementConstraints:    taskDef.PlacementConstraints,
-		TaskRoleArn:             taskDef.TaskRoleArn,
-		Volumes:                 taskDef.Volumes,
-		RequiresCompatibilities: taskDef.RequiresCompatibilities,
-	}
-
-	res, err := client.RegisterTaskDefinition(params)
-	if err != nil {
-		return nil, err
-	}
-
-	return res.TaskDefinition, nil
-}
-
-func (f *deployCmd) tagDockerImage(ecrClient *ecr.ECR, repoName string, fromTag string, toTag string) error {
-	params := &ecr.BatchGetImageInput{
-		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(fromTag)}},
-		RepositoryName: aws.String(repoName),
-
-		AcceptedMediaTypes: []*string{
-			aws.String("application/vnd.docker.distribution.manifest.v1+json"),
-			aws.String("application/vnd.docker.distribution.manifest.v2+json"),
-			aws.String("application/vnd.oci.image.manifest.v1+json"),
-		},
-	}
-	img, err := ecrClient.BatchGetImage(params)
+	// The resolved digests are recorded as a structured field on the
+	// history entry, not just folded into the free-text message, so a
+	// later `ship history` shows exactly what was pinned without parsing
+	// it out of a sentence. rollback does not read this field, and the
+	// entries it records carry no digest.
+	err = historyManager.PushState(int(*registerdTaskDef.Revision), historyMsg, formatDigests(digests), historyEntryDeploy)
 	if err != nil {
 		return err
 	}
 
-	putParams := &ecr.PutImageInput{
-		ImageManifest:  img.Images[0].ImageManifest,
-		RepositoryName: aws.String(repoName),
-		ImageTag:       aws.String(toTag),
-	}
-	_, err = ecrClient.PutImage(putParams)
-	if err != nil {
-		return err
-	}
+	msg = fmt.Sprintf("successfully updated\n")
+	l.Log(msg)
+	l.Slack("good", msg)
 
 	return nil
 }
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// History entry types, recorded on every PushState. rollback relies on
+// historyEntryRunTask to tell one-off task runs apart from actual service
+// revisions when it looks for the previous revision to target, since a
+// migration/rake task definition must never become a rollback target.
+const (
+	historyEntryDeploy   = "deploy"
+	historyEntryRollback = "rollback"
+	historyEntryRunTask  = "run-task"
+)
+
+type historyCmd struct {
+	cluster     string
+	serviceName string
+	backend     string
+	limit       int
+}
+
+func NewHistoryCommand(out, errOut io.Writer) *cobra.Command {
+	f := &historyCmd{}
+	cmd := &cobra.Command{
+		Use:   "history [options]",
+		Short: "List past deploy, rollback and run-task states of a service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return f.execute(cmd, args, out)
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
+	cmd.Flags().IntVar(&f.limit, "limit", 10, "number of history entries to show")
+
+	return cmd
+}
+
+func (f *historyCmd) execute(_ *cobra.Command, args []string, out io.Writer) error {
+	if f.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return errors.New("--service-name is required")
+	}
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName)
+	if err != nil {
+		return err
+	}
+
+	states, err := historyManager.States(f.limit)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range states {
+		line := fmt.Sprintf("%s\t%s\trevision %d\t%s", s.Timestamp.Format("2006-01-02T15:04:05Z07:00"), s.Type, s.Revision, s.Message)
+		if s.Digest != "" {
+			line = fmt.Sprintf("%s\t%s", line, s.Digest)
+		}
+		fmt.Fprintf(out, "%s\n", line)
+	}
+
+	return nil
+}
@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// ImageBackend copies an image manifest from one tag to another in the
+// registry that hosts it, so a task definition can reference the new tag
+// without the underlying image bytes changing. It can also resolve the
+// content digest of a tag, for --pin-digest deploys.
+type ImageBackend interface {
+	Retag(ctx context.Context, image *dockerImage, fromTag, toTag string) error
+	Digest(ctx context.Context, image *dockerImage, tag string) (string, error)
+}
+
+// imageBackendFor selects the ImageBackend responsible for image, based on
+// its registry hostname. Containers with no matching --image option are
+// handled by a no-op backend, since there is nothing to retag.
+func imageBackendFor(images *imageOptions, ecrClient *ecr.ECR, image *dockerImage) ImageBackend {
+	if images.Get(image.RepositoryName) == nil {
+		return noopImageBackend{}
+	}
+
+	if isECRHosted(image) {
+		return &ecrImageBackend{client: ecrClient}
+	}
+
+	return &registryV2ImageBackend{host: registryHost(image.HostName)}
+}
+
+//
+// ECR
+//
+
+type ecrImageBackend struct {
+	client *ecr.ECR
+}
+
+func (b *ecrImageBackend) Retag(ctx context.Context, image *dockerImage, fromTag, toTag string) error {
+	return tagDockerImage(b.client, image.RepositoryName, fromTag, toTag)
+}
+
+func (b *ecrImageBackend) Digest(ctx context.Context, image *dockerImage, tag string) (string, error) {
+	res, err := b.client.BatchGetImage(&ecr.BatchGetImageInput{
+		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+		RepositoryName: aws.String(image.RepositoryName),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *res.Images[0].ImageId.ImageDigest, nil
+}
+
+//
+// Docker Registry v2 (Docker Hub, GHCR, GCR, Quay, generic)
+//
+
+const dockerHubRegistryHost = "registry-1.docker.io"
+
+// manifestAcceptTypes lists the media types accepted when fetching a
+// manifest, including the multi-arch list/index types. Docker Hub serves
+// most tags as a manifest list rather than a single-platform manifest;
+// without these, the registry falls back to resolving a single platform
+// and Retag/Digest would silently operate on the wrong object.
+var manifestAcceptTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+func setManifestAccept(req *http.Request) {
+	for _, t := range manifestAcceptTypes {
+		req.Header.Add("Accept", t)
+	}
+}
+
+// dockerHubConfigAuthKey is the key ~/.docker/config.json stores Docker
+// Hub credentials under for historical reasons, unrelated to the v2 API
+// host it's actually served from.
+const dockerHubConfigAuthKey = "https://index.docker.io/v1/"
+
+// registryHost maps an image hostname to the host its v2 API is served
+// from. Docker Hub images carry no hostname (or "docker.io") but are
+// served from registry-1.docker.io.
+func registryHost(host string) string {
+	if host == "" || host == "docker.io" || host == "index.docker.io" {
+		return dockerHubRegistryHost
+	}
+	return host
+}
+
+// configAuthHost maps a v2 API host back to the key its credentials are
+// stored under in ~/.docker/config.json.
+func configAuthHost(host string) string {
+	if host == dockerHubRegistryHost {
+		return dockerHubConfigAuthKey
+	}
+	return host
+}
+
+type registryV2ImageBackend struct {
+	host string
+}
+
+func (b *registryV2ImageBackend) Retag(ctx context.Context, image *dockerImage, fromTag, toTag string) error {
+	auth, err := dockerConfigAuth(configAuthHost(b.host))
+	if err != nil {
+		return err
+	}
+
+	manifest, mediaType, err := b.getManifest(image.RepositoryName, fromTag, auth)
+	if err != nil {
+		return err
+	}
+
+	return b.putManifest(image.RepositoryName, toTag, mediaType, manifest, auth)
+}
+
+func (b *registryV2ImageBackend) Digest(ctx context.Context, image *dockerImage, tag string) (string, error) {
+	auth, err := dockerConfigAuth(configAuthHost(b.host))
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("https://%s/v2/%s/manifests/%s", b.host, image.RepositoryName, tag), nil)
+	if err != nil {
+		return "", err
+	}
+	setManifestAccept(req)
+
+	res, err := b.do(req, image.RepositoryName, auth)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to head manifest for %s:%s: %s", image.RepositoryName, tag, res.Status)
+	}
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("no Docker-Content-Digest header for %s:%s", image.RepositoryName, tag)
+	}
+
+	return digest, nil
+}
+
+func (b *registryV2ImageBackend) getManifest(repoName, tag, auth string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/v2/%s/manifests/%s", b.host, repoName, tag), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	setManifestAccept(req)
+
+	res, err := b.do(req, repoName, auth)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to get manifest for %s:%s: %s", repoName, tag, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, res.Header.Get("Content-Type"), nil
+}
+
+func (b *registryV2ImageBackend) putManifest(repoName, tag, mediaType string, manifest []byte, auth string) error {
+	req, err := http.NewRequest("PUT", fmt.Sprintf("https://%s/v2/%s/manifests/%s", b.host, repoName, tag), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	res, err := b.do(req, repoName, auth)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to put manifest for %s:%s: %s", repoName, tag, res.Status)
+	}
+
+	return nil
+}
+
+func setBasicAuth(req *http.Request, auth string) {
+	if auth != "" {
+		req.Header.Set("Authorization", "Basic "+auth)
+	}
+}
+
+// do sends req with the configured Basic auth, and transparently performs
+// the Docker Registry v2 bearer-token handshake when the registry answers
+// with a 401 Bearer challenge, which Docker Hub, GHCR, GCR and Quay all
+// require for anything beyond anonymous public pulls.
+func (b *registryV2ImageBackend) do(req *http.Request, repoName, auth string) (*http.Response, error) {
+	setBasicAuth(req, auth)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	res.Body.Close()
+
+	token, err := fetchBearerToken(challenge, repoName, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+
+	return http.DefaultClient.Do(retry)
+}
+
+// fetchBearerToken exchanges the Basic credentials in auth for a bearer
+// token at the realm named in a "WWW-Authenticate: Bearer ..." challenge,
+// per the Docker Registry v2 token authentication spec.
+func fetchBearerToken(challenge, repoName, auth string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported auth challenge for %s: %s", repoName, challenge)
+	}
+
+	params := parseAuthChallenge(strings.TrimPrefix(challenge, "Bearer "))
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("no realm in auth challenge for %s: %s", repoName, challenge)
+	}
+
+	req, err := http.NewRequest("GET", realm, nil)
+	if err != nil {
+		return "", err
+	}
+
+	q := req.URL.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		q.Set("scope", scope)
+	}
+	req.URL.RawQuery = q.Encode()
+	setBasicAuth(req, auth)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch auth token for %s: %s", repoName, res.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+
+	return body.AccessToken, nil
+}
+
+// parseAuthChallenge parses the comma-separated key="value" pairs of a
+// WWW-Authenticate challenge (with the scheme already stripped).
+func parseAuthChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+	// Split only on commas outside quotes: a quoted value such as
+	// scope="repository:foo:pull,push" holds commas of its own.
+	var parts []string
+	start, inQuotes := 0, false
+	for i, c := range challenge {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == ',' && !inQuotes:
+			parts = append(parts, challenge[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, challenge[start:])
+	for _, part := range parts {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+//
+// no-op passthrough
+//
+
+// noopImageBackend leaves the image untouched, for containers that aren't
+// part of the current deploy and should be copied into the new task
+// definition verbatim.
+type noopImageBackend struct{}
+
+func (noopImageBackend) Retag(ctx context.Context, image *dockerImage, fromTag, toTag string) error {
+	return nil
+}
+
+func (noopImageBackend) Digest(ctx context.Context, image *dockerImage, tag string) (string, error) {
+	return "", fmt.Errorf("no image backend configured for %s", image.RepositoryName)
+}
+
+//
+// credential resolution
+//
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+}
+
+// dockerConfigAuth returns the base64-encoded "user:password" auth string
+// configured for host in the standard ~/.docker/config.json, or "" if
+// none is configured.
+func dockerConfigAuth(host string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", err
+	}
+
+	return cfg.Auths[host].Auth, nil
+}
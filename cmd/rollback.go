@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/spf13/cobra"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+// rollbackLookback bounds how far back into history rollback searches for
+// the previous service revision, skipping over any run-task entries it
+// finds along the way.
+const rollbackLookback = 50
+
+type rollbackCmd struct {
+	cluster         string
+	serviceName     string
+	toRevision      int
+	backend         string
+	slackWebhookUrl string
+}
+
+func NewRollbackCommand(out, errOut io.Writer) *cobra.Command {
+	f := &rollbackCmd{}
+	cmd := &cobra.Command{
+		Use:   "rollback [options]",
+		Short: "Roll a service back to a previous task definition revision",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.NewLogger(f.cluster, f.serviceName, f.slackWebhookUrl, out)
+			err := f.execute(cmd, args, l)
+			if err != nil {
+				msg := fmt.Sprintf("failed to rollback. cluster: %s, serviceName: %s\n", f.cluster, f.serviceName)
+				l.Log(msg)
+				l.Slack("danger", msg)
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().IntVar(&f.toRevision, "to-revision", 0, "task definition revision to roll back to (defaults to the previous deploy)")
+	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
+	cmd.Flags().StringVar(&f.slackWebhookUrl, "slack-webhook-url", "", "slack webhook URL")
+
+	return cmd
+}
+
+func (f *rollbackCmd) execute(_ *cobra.Command, args []string, l *log.Logger) error {
+	if f.cluster == "" {
+		return errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return errors.New("--service-name is required")
+	}
+
+	region := getAWSRegion()
+	if region == "" {
+		return errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+
+	client := ecs.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName)
+	if err != nil {
+		return err
+	}
+
+	service, err := libecs.DescribeService(client, f.cluster, f.serviceName)
+	if err != nil {
+		return err
+	}
+
+	if len(service.Deployments) > 1 {
+		return errors.New(fmt.Sprintf("%s is currently deploying", f.serviceName))
+	}
+
+	var targetRevision int
+	var targetMessage string
+	if f.toRevision != 0 {
+		targetRevision = f.toRevision
+		targetMessage = fmt.Sprintf("rollback: -> %d", targetRevision)
+	} else {
+		// Peek the history stack rather than popping it: the stack stays
+		// untouched until the update below actually succeeds, so a failed
+		// or aborted rollback never corrupts it. The most recent deploy or
+		// rollback entry is the revision the service is running now; the
+		// one before that is the real rollback target. run-task entries
+		// are skipped - a one-off task definition was never the service's
+		// running revision and must never become a rollback target.
+		states, err := historyManager.States(rollbackLookback)
+		if err != nil {
+			return err
+		}
+
+		var serviceStates []*HistoryState
+		for _, s := range states {
+			if s.Type == historyEntryRunTask {
+				continue
+			}
+			serviceStates = append(serviceStates, s)
+			if len(serviceStates) == 2 {
+				break
+			}
+		}
+		if len(serviceStates) < 2 {
+			return errors.New("no previous revision to roll back to")
+		}
+		targetRevision = serviceStates[1].Revision
+		targetMessage = fmt.Sprintf("rollback: %s", serviceStates[1].Message)
+	}
+
+	targetArn, err := libecs.SpecifyRevision(targetRevision, *service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+
+	targetTaskDef, err := libecs.DescribeTaskDefinition(client, targetArn)
+	if err != nil {
+		return err
+	}
+
+	currentTaskDef, err := libecs.DescribeTaskDefinition(client, *service.TaskDefinition)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("rollback: revision %d -> %d\n", *currentTaskDef.Revision, *targetTaskDef.Revision)
+	l.Log(msg)
+	l.Slack("normal", msg)
+
+	err = libecs.UpdateService(client, service, targetTaskDef)
+	if err != nil {
+		return err
+	}
+
+	l.Log(fmt.Sprintf("service updating\n"))
+
+	err = libecs.WaitUpdateService(client, f.cluster, f.serviceName, l)
+	if err != nil {
+		return err
+	}
+
+	err = historyManager.PushState(int(*targetTaskDef.Revision), targetMessage, "", historyEntryRollback)
+	if err != nil {
+		return err
+	}
+
+	msg = fmt.Sprintf("successfully rolled back\n")
+	l.Log(msg)
+	l.Slack("good", msg)
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/oklog/ulid"
+	"github.com/spf13/cobra"
+
+	libecs "github.com/SKAhack/shipctl/lib/ecs"
+	log "github.com/SKAhack/shipctl/lib/logger"
+)
+
+type runTaskCmd struct {
+	cluster         string
+	serviceName     string
+	revision        int
+	images          imageOptions
+	backend         string
+	launchType      string
+	subnets         []string
+	securityGroups  []string
+	wait            bool
+	slackWebhookUrl string
+}
+
+func NewRunTaskCommand(out, errOut io.Writer) *cobra.Command {
+	f := &runTaskCmd{}
+	cmd := &cobra.Command{
+		Use:   "run-task [options]",
+		Short: "Register a one-off task definition and run it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.NewLogger(f.cluster, f.serviceName, f.slackWebhookUrl, out)
+			code, err := f.execute(cmd, args, l)
+			if err != nil {
+				msg := fmt.Sprintf("failed to run-task. cluster: %s, serviceName: %s\n", f.cluster, f.serviceName)
+				l.Log(msg)
+				l.Slack("danger", msg)
+				return err
+			}
+			if code != 0 {
+				os.Exit(code)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&f.cluster, "cluster", "", "ECS Cluster Name")
+	cmd.Flags().StringVar(&f.serviceName, "service-name", "", "ECS Service Name")
+	cmd.Flags().IntVar(&f.revision, "revision", 0, "revision of ECS task definition")
+	cmd.Flags().Var(&f.images, "image", "base image of ECR image")
+	cmd.Flags().StringVar(&f.backend, "backend", "SSM", "Backend type of history manager")
+	cmd.Flags().StringVar(&f.launchType, "launch-type", "FARGATE", "ECS launch type (FARGATE or EC2)")
+	cmd.Flags().StringSliceVar(&f.subnets, "subnet", nil, "subnet ID for the task network configuration (repeatable)")
+	cmd.Flags().StringSliceVar(&f.securityGroups, "security-group", nil, "security group ID for the task network configuration (repeatable)")
+	cmd.Flags().BoolVar(&f.wait, "wait", false, "wait for the task to finish and stream its logs")
+	cmd.Flags().StringVar(&f.slackWebhookUrl, "slack-webhook-url", "", "slack webhook URL")
+
+	return cmd
+}
+
+// execute registers a new task definition from the service's task family,
+// runs it once, and (with --wait) returns the exit code of its container.
+func (f *runTaskCmd) execute(_ *cobra.Command, args []string, l *log.Logger) (int, error) {
+	if f.cluster == "" {
+		return 0, errors.New("--cluster is required")
+	}
+
+	if f.serviceName == "" {
+		return 0, errors.New("--service-name is required")
+	}
+
+	if len(f.images.Value) == 0 {
+		return 0, errors.New("--image is required")
+	}
+
+	region := getAWSRegion()
+	if region == "" {
+		return 0, errors.New("AWS region is not found. please set a AWS_DEFAULT_REGION or AWS_REGION")
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return 0, err
+	}
+
+	client := ecs.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	ecrClient := ecr.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	historyManager, err := NewHistoryManager(f.backend, f.cluster, f.serviceName)
+	if err != nil {
+		return 0, err
+	}
+
+	service, err := libecs.DescribeService(client, f.cluster, f.serviceName)
+	if err != nil {
+		return 0, err
+	}
+
+	var uniqueID string
+	{
+		entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+		uniqueID = ulid.MustNew(ulid.Now(), entropy).String()
+	}
+
+	var registerdTaskDef *ecs.TaskDefinition
+	{
+		taskDefArn := *service.TaskDefinition
+		taskDefArn, err = libecs.SpecifyRevision(f.revision, taskDefArn)
+		if err != nil {
+			return 0, err
+		}
+
+		taskDef, err := libecs.DescribeTaskDefinition(client, taskDefArn)
+		if err != nil {
+			return 0, err
+		}
+
+		newTaskDef, _, err := createNewTaskDefinition(&f.images, ecrClient, uniqueID, taskDef, false)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, v := range taskDef.ContainerDefinitions {
+			img, err := parseDockerImage(*v.Image)
+			if err != nil {
+				return 0, err
+			}
+
+			opt := f.images.Get(img.RepositoryName)
+			if opt == nil {
+				continue
+			}
+
+			backend := imageBackendFor(&f.images, ecrClient, img)
+			err = backend.Retag(context.Background(), img, opt.Tag, uniqueID)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		registerdTaskDef, err = registerTaskDefinition(client, newTaskDef)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	msg := fmt.Sprintf("run-task: registered revision %d\n", *registerdTaskDef.Revision)
+	l.Log(msg)
+	l.Slack("normal", msg)
+
+	task, err := libecs.RunTask(client, f.cluster, *registerdTaskDef.TaskDefinitionArn, f.launchType, f.subnets, f.securityGroups)
+	if err != nil {
+		return 0, err
+	}
+
+	// Recorded as a historyEntryRunTask entry so `ship history` shows it,
+	// while rollback's search for the previous service revision explicitly
+	// skips this type - a migration/rake task definition must never become
+	// a rollback target.
+	err = historyManager.PushState(int(*registerdTaskDef.Revision), fmt.Sprintf("run-task: %s", *task.TaskArn), "", historyEntryRunTask)
+	if err != nil {
+		return 0, err
+	}
+
+	if !f.wait {
+		l.Log(fmt.Sprintf("task started: %s\n", *task.TaskArn))
+		return 0, nil
+	}
+
+	exitCode, err := f.waitAndStreamLogs(sess, client, region, registerdTaskDef, task, l)
+	if err != nil {
+		return 0, err
+	}
+
+	msg = fmt.Sprintf("task finished with exit code %d\n", exitCode)
+	l.Log(msg)
+	if exitCode == 0 {
+		l.Slack("good", msg)
+	} else {
+		l.Slack("danger", msg)
+	}
+
+	return exitCode, nil
+}
+
+// waitAndStreamLogs blocks until the task stops, tailing the CloudWatch
+// Logs stream of the task definition's first container when that container
+// uses the awslogs driver, and returns the exit code reported for that
+// container. Logs of the other containers are not streamed.
+func (f *runTaskCmd) waitAndStreamLogs(sess *session.Session, client *ecs.ECS, region string, taskDef *ecs.TaskDefinition, task *ecs.Task, l *log.Logger) (int, error) {
+	logsClient := cloudwatchlogs.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	container := taskDef.ContainerDefinitions[0]
+	var logGroup, logStream string
+	if container.LogConfiguration != nil && *container.LogConfiguration.LogDriver == "awslogs" {
+		logGroup = *container.LogConfiguration.Options["awslogs-group"]
+		prefix := *container.LogConfiguration.Options["awslogs-stream-prefix"]
+		taskID := (*task.TaskArn)[strings.LastIndex(*task.TaskArn, "/")+1:]
+		logStream = fmt.Sprintf("%s/%s/%s", prefix, *container.Name, taskID)
+	}
+
+	var nextToken *string
+	for {
+		if logGroup != "" {
+			nextToken = streamLogEvents(logsClient, logGroup, logStream, nextToken, l)
+		}
+
+		stopped, err := libecs.WaitTaskStopped(client, f.cluster, *task.TaskArn)
+		if err != nil {
+			return 0, err
+		}
+		if stopped {
+			break
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+
+	if logGroup != "" {
+		streamLogEvents(logsClient, logGroup, logStream, nextToken, l)
+	}
+
+	finalTask, err := libecs.DescribeTask(client, f.cluster, *task.TaskArn)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range finalTask.Containers {
+		if *c.Name == *container.Name {
+			if c.ExitCode == nil {
+				return -1, nil
+			}
+			return int(*c.ExitCode), nil
+		}
+	}
+
+	return -1, nil
+}
+
+func streamLogEvents(client *cloudwatchlogs.CloudWatchLogs, logGroup, logStream string, nextToken *string, l *log.Logger) *string {
+	params := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(logGroup),
+		LogStreamName: aws.String(logStream),
+		StartFromHead: aws.Bool(true),
+	}
+	if nextToken != nil {
+		params.NextToken = nextToken
+	}
+
+	res, err := client.GetLogEvents(params)
+	if err != nil {
+		return nextToken
+	}
+
+	for _, e := range res.Events {
+		l.Log(fmt.Sprintf("%s\n", *e.Message))
+	}
+
+	return res.NextForwardToken
+}
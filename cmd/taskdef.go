@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/docker/distribution/reference"
+)
+
+// createNewTaskDefinition builds a copy of taskDef with every container
+// kept. Containers covered by an --image option are repointed at the tag
+// id (or, with pinDigest, at their resolved content digest); the rest are
+// left untouched (see imageBackendFor). It also returns the digests
+// resolved for pinned containers, keyed by repository name, so callers
+// can record them in history.
+func createNewTaskDefinition(images *imageOptions, ecrClient *ecr.ECR, id string, taskDef *ecs.TaskDefinition, pinDigest bool) (*ecs.TaskDefinition, map[string]string, error) {
+	newTaskDef := *taskDef // shallow copy
+	containers := make([]*ecs.ContainerDefinition, len(taskDef.ContainerDefinitions))
+	digests := map[string]string{}
+	for i, vp := range taskDef.ContainerDefinitions {
+		v := *vp // shallow copy
+		img, err := parseDockerImage(*v.Image)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		backend := imageBackendFor(images, ecrClient, img)
+		if _, ok := backend.(noopImageBackend); !ok {
+			if pinDigest {
+				opt := images.Get(img.RepositoryName)
+				digest, err := backend.Digest(context.Background(), img, opt.Tag)
+				if err != nil {
+					return nil, nil, err
+				}
+				v.Image = aws.String(fmt.Sprintf("%s@%s", img.Name, digest))
+				digests[img.RepositoryName] = digest
+			} else {
+				v.Image = aws.String(fmt.Sprintf("%s:%s", img.Name, id))
+			}
+		}
+		containers[i] = &v
+	}
+	newTaskDef.ContainerDefinitions = containers
+
+	return &newTaskDef, digests, nil
+}
+
+// formatDigests renders the repo->digest map resolved by
+// createNewTaskDefinition into a stable, human-readable string for the
+// structured Digest field of a history entry. Returns "" when pinDigest
+// wasn't used, so non-pinned deploys don't carry a meaningless value.
+func formatDigests(digests map[string]string) string {
+	if len(digests) == 0 {
+		return ""
+	}
+
+	repos := make([]string, 0, len(digests))
+	for repo := range digests {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	parts := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		parts = append(parts, fmt.Sprintf("%s@%s", repo, digests[repo]))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+type dockerImage struct {
+	Name           string
+	Tag            string
+	RepositoryName string
+	HostName       string
+}
+
+func parseDockerImage(image string) (*dockerImage, error) {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return nil, err
+	}
+
+	hostName, repoName := reference.SplitHostname(ref.(reference.Named))
+	return &dockerImage{
+		Name:           ref.(reference.Named).Name(),
+		Tag:            ref.(reference.Tagged).Tag(),
+		RepositoryName: repoName,
+		HostName:       hostName,
+	}, nil
+}
+
+func isECRHosted(image *dockerImage) bool {
+	return ECRRegex.MatchString(image.HostName)
+}
+
+func registerTaskDefinition(client *ecs.ECS, taskDef *ecs.TaskDefinition) (*ecs.TaskDefinition, error) {
+	params := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDef.ContainerDefinitions,
+		Cpu:                     taskDef.Cpu,
+		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
+		Family:                  taskDef.Family,
+		Memory:                  taskDef.Memory,
+		NetworkMode:             taskDef.NetworkMode,
+		PlacementConstraints:    taskDef.PlacementConstraints,
+		TaskRoleArn:             taskDef.TaskRoleArn,
+		Volumes:                 taskDef.Volumes,
+		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+	}
+
+	res, err := client.RegisterTaskDefinition(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.TaskDefinition, nil
+}
+
+func tagDockerImage(ecrClient *ecr.ECR, repoName string, fromTag string, toTag string) error {
+	params := &ecr.BatchGetImageInput{
+		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(fromTag)}},
+		RepositoryName: aws.String(repoName),
+
+		AcceptedMediaTypes: []*string{
+			aws.String("application/vnd.docker.distribution.manifest.v1+json"),
+			aws.String("application/vnd.docker.distribution.manifest.v2+json"),
+			aws.String("application/vnd.oci.image.manifest.v1+json"),
+		},
+	}
+	img, err := ecrClient.BatchGetImage(params)
+	if err != nil {
+		return err
+	}
+
+	putParams := &ecr.PutImageInput{
+		ImageManifest:  img.Images[0].ImageManifest,
+		RepositoryName: aws.String(repoName),
+		ImageTag:       aws.String(toTag),
+	}
+	_, err = ecrClient.PutImage(putParams)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}